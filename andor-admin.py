@@ -1,6 +1,9 @@
 import string
 import os
 import sys
+import csv
+import json
+from datetime import datetime, timedelta
 import shutil
 import getpass
 from libdataset import dataset
@@ -29,7 +32,10 @@ Verbs:
 
     help         display this help message
     add-user     add a new users to the system
+    list-users   list users and their roles as CSV or JSON
+    inactive-users list users who haven't logged in recently
     disable-user disable a user account
+    enable-user  re-enable a disabled user account
     email        set a user's email address
     display-name set a user's display name
     password     set a user's password
@@ -37,6 +43,10 @@ Verbs:
     create-role  defines a role
     edit-role    changes a role's permissions
     delete-role  deletes a role
+    rename       renames an object's key leaving an alias behind
+    migrate-keys moves mixed case keys to their lower case form
+    verify       checks the collections and object aliases
+    purge        permanently removes an object and its aliases
 
 Verbs except for help require one or more parameters.
 Envoking the verb without a parameter will display a
@@ -58,6 +68,7 @@ def add_user(argv):
         usage_add_user()
         return False
     username, email, display_name = argv[0], argv[1], argv[2]
+    username = models.normalize_key(c_name, username)
     if dataset.key_exists(c_name, username) == True:
         print(f'{username} already exists in {c_name}')
         return False
@@ -74,6 +85,87 @@ def add_user(argv):
     return True
 
 
+def usage_list_users():
+    print(f'''
+USAGE: {cli_name} list-users [--json]
+
+Writes a report of all users and their assigned roles to
+standard out as CSV (the default) or JSON, e.g. for periodic
+access reviews.
+
+E.g. {cli_name} list-users > users.csv
+
+''')
+
+def list_users(argv):
+    c_name = cfg.USERS
+    if len(argv) > 1 or (len(argv) == 1 and argv[0] != '--json'):
+        usage_list_users()
+        return False
+    fields = [ 'username', 'display_name', 'email', 'role', 'last_login', 'active' ]
+    keys = dataset.keys(c_name)
+    keys.sort()
+    users, err = dataset.read_list(c_name, keys)
+    if err != '':
+        print(f'ERROR: reading {c_name}, {err}')
+        return False
+    rows = []
+    for user in users:
+        row = { field: user.get(field, '') for field in fields }
+        row['active'] = user.get('active', True)
+        rows.append(row)
+    if len(argv) == 1:
+        print(json.dumps(rows, indent = 4))
+        return True
+    w = csv.DictWriter(sys.stdout, fieldnames = fields)
+    w.writeheader()
+    w.writerows(rows)
+    return True
+
+
+def usage_inactive_users():
+    print(f'''
+USAGE: {cli_name} inactive-users DAYS [--disable]
+
+Lists active users who have not logged in for DAYS or more
+(including users who have never logged in). With --disable
+those accounts are also disabled, use enable-user to restore
+access.
+
+E.g. {cli_name} inactive-users 180 --disable
+
+''')
+
+def inactive_users(argv):
+    c_name = cfg.USERS
+    if len(argv) not in [ 1, 2 ] or argv[0].isdigit() == False:
+        usage_inactive_users()
+        return False
+    if len(argv) == 2 and argv[1] != '--disable':
+        usage_inactive_users()
+        return False
+    do_disable = (len(argv) == 2)
+    cutoff = datetime.now() - timedelta(days = int(argv[0]))
+    cutoff = cutoff.strftime('%Y-%m-%d %H:%M:%S')
+    keys = dataset.keys(c_name)
+    keys.sort()
+    users, err = dataset.read_list(c_name, keys)
+    if err != '':
+        print(f'ERROR: reading {c_name}, {err}')
+        return False
+    ok = True
+    for user in users:
+        username = user.get('username', '')
+        last_login = user.get('last_login', '')
+        if user.get('active', True) == False or last_login >= cutoff:
+            continue
+        print(f"{username}\t{last_login or 'never'}")
+        if do_disable and disable_user([ username ]) == False:
+            print(f'ERROR: failed to disable {username}')
+            ok = False
+    return ok
+
+
 def usage_disable_user():
     print(f'''
 USAGE: {cli_name} disable-user USERNAME
@@ -87,15 +179,34 @@ def disable_user(argv):
     if len(argv) != 1:
         usage_disable_user()
         return False
-    username = argv[0]
+    username = models.normalize_key(c_name, argv[0])
     if dataset.key_exists(c_name, username) == False:
         print(f'{username} not found in {c_name}')
         return False
-    u = models.User(c_name)
-    if u.get(username) == False:
+    u = models.User(username)
+    u.active = False
+    return u.save()
+
+
+def usage_enable_user():
+    print(f'''
+USAGE: {cli_name} enable-user USERNAME
+
+E.g. {cli_name} enable-user jsteinbeck
+
+''')
+
+def enable_user(argv):
+    c_name = cfg.USERS
+    if len(argv) != 1:
+        usage_enable_user()
+        return False
+    username = models.normalize_key(c_name, argv[0])
+    if dataset.key_exists(c_name, username) == False:
         print(f'{username} not found in {c_name}')
         return False
-    u.is_active = False
+    u = models.User(username)
+    u.active = True
     return u.save()
 
 
@@ -116,7 +227,7 @@ def set_password(argv):
     c_name = cfg.USERS
     if len(argv) < 1:
         return usage_password()
-    username = argv[0]
+    username = models.normalize_key(c_name, argv[0])
     pw1, pw2 = '', ' '
     i = 0
     while pw1 != pw2:
@@ -154,13 +265,11 @@ def set_email(argv):
     c_name = cfg.USERS
     if len(argv) != 2:
         return usage_set_email()
-    username, email = argv[0], argv[1]
+    username, email = models.normalize_key(c_name, argv[0]), argv[1]
     if dataset.key_exists(c_name, username) == True:
-        u = models.User(c_name)
-        if u.get(username):
-            u.email = email
-            return u.save()
-        return True
+        u = models.User(username)
+        u.email = email
+        return u.save()
     print(f'{username} does not exist in {c_name}')
     return False
 
@@ -179,13 +288,11 @@ def set_display_name(argv):
     c_name = cfg.USERS
     if len(argv) != 2:
         return usage_set_email()
-    username, display_name = argv[0], argv[1]
+    username, display_name = models.normalize_key(c_name, argv[0]), argv[1]
     if dataset.key_exists(c_name, username) == True:
-        u = models.User(c_name)
-        if u.get(username):
-            u.display_name = display_name
-            return u.save()
-        return True
+        u = models.User(username)
+        u.display_name = display_name
+        return u.save()
     print(f'{username} does not exist in {c_name}')
     return False
 
@@ -204,7 +311,7 @@ def assign_role(argv):
     c_name = cfg.USERS
     if len(argv) != 2:
         return usage_asign_role()
-    username, role = argv[0], argv[1]
+    username, role = models.normalize_key(c_name, argv[0]), argv[1]
     if dataset.key_exists(c_name, username) == False:
         print(f'{username} does not exist in {c_name}')
         return False
@@ -324,13 +431,243 @@ def delete_role(argv):
     print(f'{role_name} not found in {c_name}')
     return False
 
+def usage_rename():
+    print(f'''
+USAGE {cli_name} rename OLD_KEY NEW_KEY
+      {cli_name} rename --map CSV_FILENAME [--header]
+
+Moves an object in the objects collection to a new key. The
+old key is kept as an alias so existing links redirect to the
+new key. With --map the renames are read from a two column
+CSV file of old key, new key, add --header if the first row
+is a header. A summary of the rows renamed and the rows that
+failed is printed at the end.
+
+E.g. {cli_name} rename Thesis-001 thesis-001
+     {cli_name} rename --map old-to-new.csv --header
+''')
+
+def rename_key(c_name, old_key, new_key):
+    old_key = models.normalize_key(c_name, old_key)
+    people = models.People()
+    err = people.load(old_key)
+    if err == '' and people.alias != '':
+        err = f'{old_key} is already an alias of {people.alias}'
+    elif err == '' and dataset.key_exists(c_name, old_key) == False:
+        err = f'{old_key} not found in {c_name}'
+    if err == '':
+        err = people.rename(old_key, new_key)
+    return err
+
+def rename_map(c_name, csv_name, has_header):
+    # Read the whole map before renaming anything so a bad file
+    # doesn't leave a partial set of renames behind.
+    try:
+        with open(csv_name, newline = '') as fp:
+            rows = list(csv.reader(fp))
+    except (OSError, csv.Error) as err:
+        print(f'ERROR: reading {csv_name}, {err}')
+        return False
+    applied, failed = [], []
+    for i, row in enumerate(rows):
+        if len(row) < 2:
+            continue
+        old_key, new_key = row[0].strip(), row[1].strip()
+        if i == 0 and has_header:
+            continue
+        err = rename_key(c_name, old_key, new_key)
+        if err != '':
+            print(f'ERROR (row {i+1}): {err}')
+            failed.append((i+1, old_key, new_key))
+        else:
+            print(f'{old_key} -> {new_key}')
+            applied.append((i+1, old_key, new_key))
+    print(f'{len(applied)} renamed, {len(failed)} failed')
+    if len(failed) > 0:
+        print('Failed rows (fix and re-run these):')
+        for row_no, old_key, new_key in failed:
+            print(f'    row {row_no}: {old_key},{new_key}')
+    return len(failed) == 0
+
+def rename(argv):
+    c_name = cfg.OBJECTS
+    if argv[0:1] == [ '--map' ] and len(argv) in [ 2, 3 ]:
+        if len(argv) == 3 and argv[2] != '--header':
+            usage_rename()
+            return False
+        return rename_map(c_name, argv[1], len(argv) == 3)
+    if len(argv) != 2:
+        usage_rename()
+        return False
+    err = rename_key(c_name, argv[0], argv[1])
+    if err != '':
+        print(f'ERROR: {err}')
+        return False
+    return True
+
+def usage_migrate_keys():
+    print(f'''
+USAGE {cli_name} migrate-keys
+
+Moves users and objects saved under mixed case keys to their
+lower case key for the collections listed in CASE_INSENSITIVE_KEYS
+(see app/config.py). Run it after adding a collection to that
+list. Objects are renamed (see rename) so their old keys remain
+as aliases. Keys whose lower case form is already taken are
+reported and left alone.
+
+E.g. {cli_name} migrate-keys
+''')
+
+def migrate_user(c_name, old_key, new_key):
+    u = models.User(old_key)
+    u.id = new_key
+    u.username = new_key
+    if u.save() == False:
+        return f'failed to save {new_key} in {c_name}'
+    err = dataset.delete(c_name, old_key)
+    if err != '':
+        dataset.delete(c_name, new_key)
+        return err
+    return ''
+
+def migrate_keys(argv):
+    if len(argv) != 0:
+        usage_migrate_keys()
+        return False
+    ok = True
+    for c_name in getattr(cfg, 'CASE_INSENSITIVE_KEYS', []):
+        if c_name not in [ cfg.USERS, cfg.OBJECTS ]:
+            print(f'{c_name} skipped, only users and objects keys can be migrated')
+            continue
+        keys = [ key for key in dataset.keys(c_name) if key != key.lower() ]
+        keys.sort()
+        for key in keys:
+            new_key = key.lower()
+            if dataset.key_exists(c_name, new_key):
+                print(f'ERROR: {key} not migrated, {new_key} already exists in {c_name}')
+                ok = False
+                continue
+            if c_name == cfg.USERS:
+                err = migrate_user(c_name, key, new_key)
+            else:
+                err = rename_key(c_name, key, new_key)
+            if err != '':
+                print(f'ERROR: {key} not migrated, {err}')
+                ok = False
+            else:
+                print(f'{key} -> {new_key}')
+    return ok
+
+def usage_verify():
+    print(f'''
+USAGE {cli_name} verify [--repair]
+
+Checks the users, roles, objects and aliases collections for
+problem records and confirms each object alias points at an
+existing object. With --repair the collections are repaired and aliases
+to missing objects are reported for manual cleanup.
+
+E.g. {cli_name} verify --repair
+''')
+
+def verify(argv):
+    if len(argv) > 1 or (len(argv) == 1 and argv[0] != '--repair'):
+        usage_verify()
+        return False
+    do_repair = (len(argv) == 1)
+    ok = True
+    for c_name in [ cfg.USERS, cfg.ROLES, cfg.OBJECTS, getattr(cfg, 'ALIASES', '') ]:
+        if c_name == '':
+            continue
+        if dataset.check(c_name):
+            print(f'{c_name} OK')
+            continue
+        print(f'{c_name} has problems, {dataset.error_message()}')
+        if do_repair:
+            err = dataset.repair(c_name)
+            if err != '':
+                print(f'ERROR: repairing {c_name}, {err}')
+                ok = False
+            else:
+                print(f'{c_name} repaired')
+        else:
+            ok = False
+    c_name = cfg.OBJECTS
+    aliases, errors = models.alias_map()
+    if len(errors) > 0:
+        for err in errors:
+            print(f'ERROR: reading {cfg.ALIASES}, {err}')
+        return False
+    for key in sorted(aliases):
+        target = models.resolve_alias(aliases, key)
+        if target == '':
+            print(f'{key} is part of an alias loop')
+            ok = False
+        elif dataset.key_exists(c_name, target) == False:
+            print(f'{key} is an alias of missing object {target}')
+            ok = False
+    return ok
+
+def usage_purge():
+    print(f'''
+USAGE {cli_name} purge KEY
+
+Permanently removes an object (and its attachments) from the
+objects collection along with any aliases pointing at it, e.g.
+for takedown or privacy requests. This cannot be undone.
+
+E.g. {cli_name} purge thesis-001
+''')
+
+def purge(argv):
+    c_name = cfg.OBJECTS
+    if len(argv) != 1:
+        usage_purge()
+        return False
+    key = models.normalize_key(c_name, argv[0])
+    aliases, errors = models.alias_map()
+    if len(errors) > 0:
+        for err in errors:
+            print(f'ERROR: reading {cfg.ALIASES}, {err}')
+        return False
+    # Purging part of an alias chain would strand the aliases before
+    # it, so only the record itself can be purged.
+    if key in aliases and dataset.key_exists(c_name, key) == False:
+        print(f'{key} is an alias of {models.resolve_alias(aliases, key)}, purge that key instead')
+        return False
+    if dataset.key_exists(c_name, key) == False:
+        print(f'{key} not found in {c_name}')
+        return False
+    y_or_n = input(f'Permanently remove {key} from {c_name}? [y/N] ').lower()
+    if y_or_n not in [ 'y', 'yes' ]:
+        return False
+    # Remove the record first so a failure leaves its aliases working
+    err = dataset.delete(c_name, key)
+    if err != '':
+        print(f'ERROR: {err}')
+        return False
+    ok = True
+    # Aliases can chain (A -> B -> key) so remove every alias that
+    # leads to key, not just the ones pointing at it directly.
+    for alias in sorted(aliases):
+        if models.resolve_alias(aliases, alias) == key:
+            err = dataset.delete(cfg.ALIASES, alias)
+            if err != '':
+                print(f'ERROR: removing alias {alias}, {err}')
+                ok = False
+    return ok
+
 #
 # Main cli logic
 #
 verbs = {
     "help": display_help,
     "add-user": add_user,
+    "list-users": list_users,
+    "inactive-users": inactive_users,
     "disable-user": disable_user,
+    "enable-user": enable_user,
     "email": set_email,
     "display-name": set_display_name,
     "password": set_password,
@@ -338,6 +675,10 @@ verbs = {
     "create-role": create_role,
     "edit-role": edit_role,
     "delete-role": delete_role,
+    "rename": rename,
+    "migrate-keys": migrate_keys,
+    "verify": verify,
+    "purge": purge,
 }
 
 if __name__ == '__main__':
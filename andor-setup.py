@@ -9,12 +9,17 @@ def generate_development_secret(size = 1024):
     return ''.join(secrets.choice(string.ascii_lowercase + string.ascii_uppercase + string.digits + '.!@#$%^&*()-_+=') for _ in range(size))
 
 cli_name = os.path.basename(sys.argv[0])
-if len(sys.argv) != 4:
-    print(f"USAGE: {cli_name} USER_COLLECTION_NAME ROLE_COLLECTION_NAME OBJECT_COLLECTION_NAME")
+if len(sys.argv) not in [ 4, 5 ]:
+    print(f"USAGE: {cli_name} USER_COLLECTION_NAME ROLE_COLLECTION_NAME OBJECT_COLLECTION_NAME [ALIAS_COLLECTION_NAME]")
     print("E.g.")
     print(f"{cli_name} Users.ds Roles.ds Objects.ds")
     sys.exit(1)
-for c_name in sys.argv[1:]:
+# The alias collection holds the old keys of renamed objects, it
+# defaults to the object collection name with an -aliases suffix.
+c_names = sys.argv[1:]
+if len(c_names) == 3:
+    c_names.append(f'{os.path.splitext(c_names[2])[0]}-aliases.ds')
+for c_name in c_names:
     print(f"Initializing {c_name}")
     err = dataset.init(c_name)
     if err != "":
@@ -31,24 +36,31 @@ class Config(object):
     USERS = "{sys.argv[1]}"
     ROLES = "{sys.argv[2]}"
     OBJECTS = "{sys.argv[3]}"
+    ALIASES = "{c_names[3]}"
+    # Collections listed here treat keys case insensitively
+    # (e.g. CASE_INSENSITIVE_KEYS = [ USERS, OBJECTS ]), run
+    # andor-admin.py migrate-keys after adding one
+    CASE_INSENSITIVE_KEYS = []
 
 '''
 
 if os.path.exists("app/config.py"):
     print(f'''
-Updating app/config.py setting USERS, ROLES, and OBJECTS.
+Updating app/config.py setting USERS, ROLES, OBJECTS and ALIASES.
     SECRET_KEY = " ... "
     USERS = "{sys.argv[1]}"
     ROLES = "{sys.argv[2]}"
     OBJECTS = "{sys.argv[3]}"
+    ALIASES = "{c_names[3]}"
 ''')
 else:
     print(f'''
-Creating app/config.py setting USERS, ROLES, and OBJECTS.
+Creating app/config.py setting USERS, ROLES, OBJECTS and ALIASES.
     SECRET_KEY = " ... "
     USERS = "{sys.argv[1]}"
     ROLES = "{sys.argv[2]}"
     OBJECTS = "{sys.argv[3]}"
+    ALIASES = "{c_names[3]}"
 ''')
 with open("app/config.py", "w") as fp:
     fp.write(f'''{config_py}''')
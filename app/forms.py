@@ -1,5 +1,5 @@
 from flask_wtf import FlaskForm
-from wtforms import StringField, PasswordField, BooleanField, SubmitField, TextAreaField, DateTimeField
+from wtforms import StringField, PasswordField, BooleanField, SubmitField, TextAreaField, DateTimeField, HiddenField
 from wtforms.validators import DataRequired, URL, Optional, Length
 
 class SearchForm(FlaskForm):
@@ -34,5 +34,8 @@ class PeopleForm(FlaskForm):
     alumn = BooleanField('Alumni?')
     notes = TextAreaField('Notes (internal)', validators = [Optional()])
     updated = DateTimeField('updated', format='%Y-%m-%d %H:%M:%S')
+    # etag holds People.etag() of the record as it was when the form
+    # was rendered, used to detect concurrent edits.
+    etag = HiddenField('etag')
     submit = SubmitField('Save')
 
@@ -3,12 +3,78 @@ from flask_login import UserMixin
 from libdataset import dataset
 from app import cfg, login_manager
 from dataclasses import dataclass, field
+from datetime import datetime
+import hashlib
+import json
 
 
+def canonical_key(c_name, key):
+    '''canonical_key returns the form a key is stored under in c_name, lower cased if c_name is listed in cfg.CASE_INSENSITIVE_KEYS so Thesis-001 and thesis-001 refer to the same record.'''
+    if c_name in getattr(cfg, 'CASE_INSENSITIVE_KEYS', []):
+        return key.lower()
+    return key
+
+
+def normalize_key(c_name, key):
+    '''normalize_key returns the key to use for key in c_name. This is the canonical key unless c_name is case insensitive and holds a key saved before the option was turned on that only differs by case, then that key is returned so the record is found rather than duplicated until it is migrated (see andor-admin migrate-keys).'''
+    if c_name not in getattr(cfg, 'CASE_INSENSITIVE_KEYS', []):
+        return key
+    canonical = canonical_key(c_name, key)
+    if dataset.key_exists(c_name, canonical):
+        return canonical
+    for existing in dataset.keys(c_name):
+        if existing.lower() == canonical:
+            return existing
+    return canonical
+
+
+def read_batches(c_name, keys, size = 100):
+    '''read_batches reads the records for keys a batch at a time so a whole collection is never held in memory, yielding a list of objects and an error string per batch.'''
+    for i in range(0, len(keys), size):
+        yield dataset.read_list(c_name, keys[i:i+size])
+
+
+def alias_map():
+    '''alias_map returns a dict of old key to the key it was renamed to for the aliases in cfg.ALIASES (see People.rename), along with a list of read errors.'''
+    aliases, errors = {}, []
+    c_name = getattr(cfg, 'ALIASES', '')
+    if c_name == '':
+        return aliases, errors
+    for objects, err in read_batches(c_name, dataset.keys(c_name)):
+        if err != '':
+            errors.append(err)
+        for obj in objects:
+            if '_Alias' in obj and '_Key' in obj:
+                aliases[obj['_Key']] = obj['_Alias']
+    return aliases, errors
+
+
+def read_alias(key):
+    '''read_alias returns the key an object renamed from key now lives under, or '' if key isn't an alias.'''
+    c_name = getattr(cfg, 'ALIASES', '')
+    if c_name == '' or dataset.key_exists(c_name, key) == False:
+        return ''
+    obj, err = dataset.read(c_name, key)
+    if err != '':
+        return ''
+    return obj.get('_Alias', '')
+
+
+def resolve_alias(aliases, key):
+    '''resolve_alias follows a chain of aliases (A -> B -> key) to the key of the record, returning '' if the chain loops.'''
+    seen = []
+    while key in aliases:
+        if key in seen:
+            return ''
+        seen.append(key)
+        key = aliases[key]
+    return key
+
 
 def NewUser(username, email, display_name):
     '''NewUser create a new user in cfg.USERS, then returns a new User().'''
     c_name = cfg.USERS
+    username = normalize_key(c_name, username)
     user = {
         'c_name': c_name,
         'id': username,
@@ -38,9 +104,15 @@ class User(UserMixin):
     email = ''
     role = ''
     password = ''
+    # last_login is a '%Y-%m-%d %H:%M:%S' timestamp set on each login
+    last_login = ''
+    # active is False for deactivated accounts, the record is kept
+    # so references to the username remain valid.
+    active = True
 
     def __init__(self, username = ''):
         self.c_name = cfg.USERS
+        username = normalize_key(self.c_name, username)
         user = {}
         if username != '':
             user, err = dataset.read(self.c_name, username)
@@ -52,20 +124,42 @@ class User(UserMixin):
         self.email = user['email'] if 'email' in user else ''
         self.role = user['role'] if 'role' in user else ''
         self.password = user['password'] if 'password' in user else ''
+        self.last_login = user['last_login'] if 'last_login' in user else ''
+        self.active = user['active'] if 'active' in user else True
+
+    @property
+    def is_active(self):
+        return self.active
+
+    def to_dict(self):
+        return {
+            'id': self.id,
+            'username': self.username,
+            'display_name': self.display_name,
+            'email': self.email,
+            'role': self.role,
+            'password': self.password,
+            'last_login': self.last_login,
+            'active': self.active,
+        }
 
     def save(self):
         c_name = self.c_name
         key = self.username
         if dataset.key_exists(c_name, key):
-            err = dataset.update(c_name, key, self)
+            err = dataset.update(c_name, key, self.to_dict())
             if err != '':
                 return False
         else:
-            err = dataset.create(c_name, key, self)
+            err = dataset.create(c_name, key, self.to_dict())
             if err != '':
                 return False
         return True
 
+    def record_login(self):
+        self.last_login = datetime.now().strftime('%Y-%m-%d %H:%M:%S')
+        return self.save()
+
     def set_password(self, password):
         self.password = generate_password_hash(password)
         return self.save()
@@ -160,35 +254,51 @@ class People:
     faculty = False
     alumn = False
     notes = ''
+    # alias is set by load() when cl_people_id has been renamed,
+    # it holds the key the record now lives under.
+    alias = ''
+    # immutable_fields can't change once set (use rename to change
+    # cl_people_id), append_only_fields may only be added to.
+    immutable_fields = [ 'cl_people_id' ]
+    append_only_fields = [ 'notes' ]
+    # clone_fields describe more than one person and are copied when
+    # cloning, names and identifiers belong to the person cloned from.
+    clone_fields = [ 'educated_at', 'caltech', 'jpl', 'faculty', 'alumn' ]
 
     def load(self, cl_people_id):
         c_name = cfg.OBJECTS
+        cl_people_id = normalize_key(c_name, cl_people_id)
         if dataset.key_exists(c_name, cl_people_id):
             u, err = dataset.read(c_name, cl_people_id)
             if err != '':
                 return err
-            self.cl_people_id = u['cl_people_id'] if 'cl_people_id' in u else ''
-            self.family_name = u['family_name'] if 'family_name' in u else ''
-            self.given_name = u['given_name'] if 'given_name' in u else ''
-            self.thesis_id = u['thesis_id'] if 'thesis_id' in u else ''
-            self.authors_id = u['authors_id'] if 'authors_id' in u else ''
-            self.archivesspace_id = u['archivesspace_id'] if 'archivesspace_id' in u else ''
-            self.directory_id = u['directory_id'] if 'directory_id' in u else ''
-            self.viaf = u['viaf'] if 'viaf' in u else ''
-            self.lcnaf = u['lcnaf'] if 'lcnaf' in u else ''
-            self.isni = u['isni'] if 'isni' in u else ''
-            self.wikidata = u['wikidata'] if 'wikidata' in u else ''
-            self.snac = u['snac'] if 'snac' in u else ''
-            self.orcid = u['orcid'] if 'orcid' in u else ''
-            self.image = u['image'] if 'image' in u else ''
-            self.educated_at = u['educated_at'] if 'educated_at' in u else ''
-            self.caltech = u['caltech'] if 'caltech' in u else False
-            self.jpl = u['jpl'] if 'jpl' in u else False
-            self.faculty = u['faculty'] if 'faculty' in u else False
-            self.alumn = u['alumn'] if 'alumn' in u else False
-            self.notes = u['notes'] if 'notes' in u else ''
+            self.from_dict(u)
+        else:
+            self.alias = read_alias(cl_people_id)
         return ''
 
+    def from_dict(self, u):
+        self.cl_people_id = u['cl_people_id'] if 'cl_people_id' in u else ''
+        self.family_name = u['family_name'] if 'family_name' in u else ''
+        self.given_name = u['given_name'] if 'given_name' in u else ''
+        self.thesis_id = u['thesis_id'] if 'thesis_id' in u else ''
+        self.authors_id = u['authors_id'] if 'authors_id' in u else ''
+        self.archivesspace_id = u['archivesspace_id'] if 'archivesspace_id' in u else ''
+        self.directory_id = u['directory_id'] if 'directory_id' in u else ''
+        self.viaf = u['viaf'] if 'viaf' in u else ''
+        self.lcnaf = u['lcnaf'] if 'lcnaf' in u else ''
+        self.isni = u['isni'] if 'isni' in u else ''
+        self.wikidata = u['wikidata'] if 'wikidata' in u else ''
+        self.snac = u['snac'] if 'snac' in u else ''
+        self.orcid = u['orcid'] if 'orcid' in u else ''
+        self.image = u['image'] if 'image' in u else ''
+        self.educated_at = u['educated_at'] if 'educated_at' in u else ''
+        self.caltech = u['caltech'] if 'caltech' in u else False
+        self.jpl = u['jpl'] if 'jpl' in u else False
+        self.faculty = u['faculty'] if 'faculty' in u else False
+        self.alumn = u['alumn'] if 'alumn' in u else False
+        self.notes = u['notes'] if 'notes' in u else ''
+
     def to_dict(self):
         o = {}
         o['cl_people_id'] = self.cl_people_id
@@ -213,4 +323,73 @@ class People:
         o['notes'] = self.notes
         return o
 
+    def etag(self):
+        '''etag returns a content hash of the record, it changes whenever the record is saved with different values.'''
+        src = json.dumps(self.to_dict(), sort_keys = True)
+        return hashlib.sha1(src.encode('utf8')).hexdigest()
+
+    def check_update(self, stored):
+        '''check_update compares the record against the stored version (a dict) returning a list of immutable or append only field violations.'''
+        errors = []
+        o = self.to_dict()
+        for field in self.immutable_fields:
+            if stored.get(field, '') != '' and o[field] != stored[field]:
+                errors.append(f'{field} cannot be changed once set')
+        for field in self.append_only_fields:
+            # Browsers submit textarea line breaks as CRLF
+            new_val = (o[field] or '').replace('\r\n', '\n')
+            old_val = (stored.get(field, '') or '').replace('\r\n', '\n')
+            if not new_val.startswith(old_val):
+                errors.append(f'{field} can only be appended to')
+        return errors
+
+    def warnings(self):
+        '''warnings returns a list of non-blocking quality issues with the record, they are reported after a successful save.'''
+        warnings = []
+        ids = [ self.viaf, self.lcnaf, self.isni, self.wikidata, self.snac, self.orcid ]
+        if all((not val) for val in ids):
+            warnings.append('no authority identifiers (VIAF, LCNAF, ISNI, wikidata, SNAC or ORCID)')
+        if not (self.caltech or self.jpl or self.faculty or self.alumn):
+            warnings.append('no Caltech, JPL, faculty or alumni affiliation set')
+        return warnings
+
+    def rename(self, old_key, new_id):
+        '''rename moves the record loaded from old_key to new_id recording old_key in cfg.ALIASES so bookmarks and minted identifiers continue to resolve. Returns an error string.'''
+        c_name = cfg.OBJECTS
+        a_name = getattr(cfg, 'ALIASES', '')
+        if a_name == '':
+            return 'ALIASES is not set in app/config.py, see andor-setup.py'
+        new_key = canonical_key(c_name, new_id)
+        if old_key == new_key:
+            return f'{old_key} and {new_key} are the same key'
+        # Renaming Thesis-001 to thesis-001 is how mixed case keys are
+        # migrated, any other key matching new_id is a conflict.
+        existing = normalize_key(c_name, new_id)
+        if existing != old_key and dataset.key_exists(c_name, existing):
+            return f'{existing} already exists in {c_name}'
+        old_id = self.cl_people_id
+        self.cl_people_id = new_id
+        err = dataset.create(c_name, new_key, self.to_dict())
+        if err != '':
+            self.cl_people_id = old_id
+            return err
+        alias_key = canonical_key(c_name, old_key)
+        if dataset.key_exists(a_name, alias_key):
+            err = dataset.update(a_name, alias_key, { '_Alias': new_key })
+        else:
+            err = dataset.create(a_name, alias_key, { '_Alias': new_key })
+        if err == '':
+            err = dataset.delete(c_name, old_key)
+            if err != '':
+                dataset.delete(a_name, alias_key)
+        if err != '':
+            # Roll back so the record isn't left under both keys
+            dataset.delete(c_name, new_key)
+            self.cl_people_id = old_id
+            return f'failed to record alias {old_key}, {err}'
+        # Renaming back to a previous key replaces its alias
+        if dataset.key_exists(a_name, new_key):
+            dataset.delete(a_name, new_key)
+        return ''
+
 
@@ -1,20 +1,72 @@
-from flask import render_template, flash, redirect, url_for, request, escape, abort
+from flask import render_template, flash, redirect, url_for, request, escape, abort, jsonify, Response
 from flask_login import current_user, login_user, logout_user, login_required
 from app import app, cfg, login_manager
 from app.forms import LoginForm, PeopleForm, SearchForm
-from app.models import User, People
+from app.models import User, People, normalize_key, read_batches, alias_map, read_alias, resolve_alias
 from lunr import lunr
 from libdataset import dataset
 import time
 from datetime import datetime
 import sys
+import json
+import csv
+import io
+
+def flash_warnings(people):
+    '''flash_warnings reports a record's non-blocking quality warnings'''
+    for warning in people.warnings():
+        flash(f'NOTE: {warning}')
+
+def page_args():
+    '''page_args returns the offset and limit requested for a page of people'''
+    offset = max(request.args.get('offset', 0, type=int), 0)
+    limit = request.args.get('limit', 25, type=int)
+    if limit < 1:
+        limit = 25
+    return offset, limit
+
+def resolve_keys(c_name, keys):
+    '''resolve_keys normalizes keys sent by a client, following the old keys of renamed records (see People.rename) to the key the record now lives under. Returns the keys and any error messages.'''
+    aliases, errors = alias_map()
+    resolved = []
+    for key in keys:
+        key = normalize_key(c_name, f'{key}')
+        if key in aliases and dataset.key_exists(c_name, key) == False:
+            key = resolve_alias(aliases, key)
+        resolved.append(key)
+    return resolved, errors
+
+def people_keys(c_name, keys, filter_expr, sort_path, order):
+    '''people_keys returns keys (from c_name) filtered and sorted along with any error messages'''
+    errors = []
+    # filter_expr is a dataset filter expression, e.g. (eq .jpl true)
+    if filter_expr != '':
+        keys = dataset.key_filter(c_name, keys, filter_expr)
+        err = dataset.error_message()
+        if err != '':
+            errors.append(f"Can't filter {c_name}, {err}")
+    # sort_path is a dotpath (e.g. .family_name), descending order
+    # is expressed to dataset by prefixing it with a minus sign.
+    if sort_path != '':
+        sort_expr = sort_path
+        if order == 'desc':
+            sort_expr = f'-{sort_path}'
+        keys = dataset.key_sort(c_name, keys, sort_expr)
+        err = dataset.error_message()
+        if err != '':
+            errors.append(f"Can't sort {c_name}, {err}")
+    else:
+        keys.sort()
+    return keys, errors
 
 @login_manager.user_loader
 def load_user(user_id):
     c_name = cfg.USERS
-    if dataset.key_exists(c_name, user_id) == False:
+    if dataset.key_exists(c_name, normalize_key(c_name, user_id)) == False:
         return None
     u = User(user_id)
+    if u.is_active == False:
+        return None
     return u
 
 # Home page
@@ -29,25 +81,220 @@ def people_list():
     if current_user.is_authenticated == False:
         flash(f'Must be logged in to curate people')
         return redirect(url_for('index'))
-    pg = request.args.get('pg', 1, type=int)
+    offset, limit = page_args()
+    filter_expr = request.args.get('filter', '')
+    sort_path = request.args.get('sort', '')
+    order = request.args.get('order', 'asc')
     c_name = cfg.OBJECTS
     keys = dataset.keys(c_name)
     if len(keys) == 0:
         flash(f'No people in {c_name} repository, add some.')
         return redirect(url_for('people_new'))
-    keys.sort()
-#    if pg > 1:
-#        pg -= 1
-#    else:
-#        pg = 0
-#    offset = pg * 10 
-#    if len(keys) > 10:
-#        keys = keys[offset:offset+10] 
+    keys, errors = people_keys(c_name, keys, filter_expr, sort_path, order)
+    for err in errors:
+        flash(err)
+    total = len(keys)
+    keys = keys[offset:offset+limit]
     objects, err = dataset.read_list(c_name, keys)
     if err != '':
         flash(f"Can't read {c_name}, {err}")
         objects = []
-    return render_template('people_list.html', title='List People', user = current_user, objects = objects)
+    return render_template('people_list.html', title='List People', user = current_user, objects = objects, offset = offset, limit = limit, total = total, filter_expr = filter_expr, sort_path = sort_path, order = order)
+
+
+# Objects for People, returns a page of complete records as JSON,
+# taking the same offset, limit, filter, sort and order parameters
+# as the people list.
+@app.route('/people/objects')
+def people_objects():
+    if current_user.is_authenticated == False:
+        return abort(401)
+    c_name = cfg.OBJECTS
+    offset, limit = page_args()
+    keys, errors = people_keys(c_name, dataset.keys(c_name), request.args.get('filter', ''), request.args.get('sort', ''), request.args.get('order', 'asc'))
+    total = len(keys)
+    objects, err = dataset.read_list(c_name, keys[offset:offset+limit])
+    if err != '':
+        errors.append(f"Can't read {c_name}, {err}")
+    return jsonify({ 'total': total, 'offset': offset, 'limit': limit, 'objects': objects, 'errors': errors })
+
+
+# Count People, returns the number of records as JSON (the aliases
+# left by renames are kept in their own collection)
+@app.route('/people/count')
+def people_count():
+    if current_user.is_authenticated == False:
+        return abort(401)
+    c_name = cfg.OBJECTS
+    cnt = dataset.count(c_name)
+    if cnt < 0:
+        return abort(500)
+    return jsonify(cnt)
+
+
+# Export People as JSON Lines, objects are read and written a batch
+# at a time so the whole collection is never held in memory. Each
+# object keeps its _Key since it can differ from cl_people_id.
+@app.route('/people/export.jsonl')
+def people_export_jsonl():
+    if current_user.is_authenticated == False:
+        return abort(401)
+    c_name = cfg.OBJECTS
+    keys = dataset.keys(c_name)
+    keys.sort()
+    def generate():
+        for objects, err in read_batches(c_name, keys):
+            for obj in objects:
+                yield json.dumps(obj) + '\n'
+            # The response has already started so end it with an
+            # error line rather than silently leaving records out.
+            if err != '':
+                app.logger.error(f'exporting {c_name}, {err}')
+                yield json.dumps({ 'error': f"Can't read {c_name}, {err}" }) + '\n'
+                return
+    return Response(generate(), mimetype = 'application/x-ndjson')
+
+
+# Export People as CSV, columns is a comma separated list of dotpaths
+# (e.g. ?columns=.cl_people_id,.family_name,.given_name) extracted
+# with dataset's grid a batch of keys at a time.
+@app.route('/people/export.csv')
+def people_export_csv():
+    if current_user.is_authenticated == False:
+        return abort(401)
+    c_name = cfg.OBJECTS
+    columns = request.args.get('columns', '')
+    if columns == '':
+        dot_paths = [ f'.{field}' for field in People().to_dict() ]
+    else:
+        dot_paths = [ col.strip() for col in columns.split(',') if col.strip() != '' ]
+    keys = dataset.keys(c_name)
+    keys.sort()
+    def csv_row(row):
+        buf = io.StringIO()
+        csv.writer(buf).writerow(row)
+        return buf.getvalue()
+    def cell(val):
+        if val is None:
+            return ''
+        if isinstance(val, (dict, list)):
+            return json.dumps(val)
+        return val
+    def generate(size = 100):
+        yield csv_row([ p.lstrip('.') for p in dot_paths ])
+        # The response has already started so an error ends it with
+        # an ERROR row rather than silently leaving records out.
+        for i in range(0, len(keys), size):
+            rows, err = dataset.grid(c_name, keys[i:i+size], dot_paths)
+            if err != '':
+                app.logger.error(f'exporting {c_name}, {err}')
+                yield csv_row([ 'ERROR', f"Can't read {c_name}, {err}" ])
+                return
+            for row in rows:
+                yield csv_row([ cell(val) for val in row ])
+    return Response(generate(), mimetype = 'text/csv')
+
+
+# Grid of People, takes a JSON body of {"keys": [...], "dot_paths": [...]}
+# and returns a 2D JSON array with one row per key.
+@app.route('/people/grid', methods = [ "POST" ])
+def people_grid():
+    if current_user.is_authenticated == False:
+        return abort(401)
+    c_name = cfg.OBJECTS
+    body = request.get_json(silent = True)
+    if not isinstance(body, dict):
+        return abort(400)
+    keys = body.get('keys', [])
+    dot_paths = body.get('dot_paths', [])
+    if not isinstance(keys, list) or not isinstance(dot_paths, list) or len(dot_paths) == 0:
+        return abort(400)
+    keys, errors = resolve_keys(c_name, keys)
+    if len(errors) > 0:
+        return abort(500, '; '.join(errors))
+    rows, err = dataset.grid(c_name, keys, dot_paths)
+    if err != '':
+        return abort(400, err)
+    return jsonify(rows)
+
+
+# Read People, takes a JSON array of keys in the POST body (so long
+# lists and keys with slashes don't have to fit in the URL) and returns
+# the matching objects, old keys of renamed records return the record.
+# Keys that can't be read are left out and reported in error.
+@app.route('/people/read', methods = [ "POST" ])
+def people_read():
+    if current_user.is_authenticated == False:
+        return abort(401)
+    c_name = cfg.OBJECTS
+    keys = request.get_json(silent = True)
+    if not isinstance(keys, list):
+        return abort(400)
+    keys, errors = resolve_keys(c_name, keys)
+    objects, err = dataset.read_list(c_name, [ key for key in keys if key != '' ])
+    if err != '':
+        errors.append(err)
+    return jsonify({ 'objects': objects, 'error': '; '.join(errors) })
+
+
+# Warnings for People, returns a JSON object of key to the quality
+# warnings (see People.warnings) for each record that has any.
+@app.route('/people/warnings')
+def people_warnings():
+    if current_user.is_authenticated == False:
+        return abort(401)
+    c_name = cfg.OBJECTS
+    keys = dataset.keys(c_name)
+    keys.sort()
+    warnings, errors = {}, []
+    for objects, err in read_batches(c_name, keys):
+        if err != '':
+            errors.append(err)
+        for obj in objects:
+            if '_Key' not in obj:
+                continue
+            people = People()
+            people.from_dict(obj)
+            found = people.warnings()
+            if len(found) > 0:
+                warnings[obj['_Key']] = found
+    return jsonify({ 'warnings': warnings, 'errors': errors })
+
+
+# Quality for People, returns a JSON summary for curation: how many
+# records have each warning and which aliases no longer lead to a record.
+@app.route('/people/quality')
+def people_quality():
+    if current_user.is_authenticated == False:
+        return abort(401)
+    c_name = cfg.OBJECTS
+    records = dataset.keys(c_name)
+    aliases, errors = alias_map()
+    warnings, flagged = {}, 0
+    for objects, err in read_batches(c_name, records):
+        if err != '':
+            errors.append(err)
+        for obj in objects:
+            people = People()
+            people.from_dict(obj)
+            found = people.warnings()
+            if len(found) > 0:
+                flagged += 1
+            for warning in found:
+                warnings[warning] = warnings.get(warning, 0) + 1
+    broken, record_keys = {}, set(records)
+    for alias in sorted(aliases):
+        target = resolve_alias(aliases, alias)
+        if target == '' or target not in record_keys:
+            broken[alias] = aliases[alias]
+    return jsonify({
+        'records': len(records),
+        'aliases': len(aliases),
+        'with_warnings': flagged,
+        'warnings': warnings,
+        'broken_aliases': broken,
+        'errors': errors,
+    })
 
 
 # Search People
@@ -81,7 +328,7 @@ def people_search():
             # O'Brian should stem to brian, von Karman to karman).
             # NOTE: we want to save a dict of keys to object
             # for when we want to assemble our results list.
-            oMap = dict(zip(keys, objects))
+            oMap = { obj['_Key']: obj for obj in objects if '_Key' in obj }
             idx = lunr(
                     ref = "_Key",
                     fields= [ 
@@ -141,31 +388,68 @@ def people_new():
         people.alumn = form.alumn.data
         people.notes = form.notes.data
         c_name = cfg.OBJECTS
-        key = people.cl_people_id
+        key = normalize_key(c_name, people.cl_people_id)
         now = datetime.now()
+        # New records never replace existing ones, changes to an
+        # existing person go through people_edit. Old keys of renamed
+        # records stay reserved so their links keep redirecting.
         if dataset.key_exists(c_name, key):
-            err = dataset.update(c_name, key, people.to_dict())
-            if err != '':
-                flash(f'WARNING: failed to update {key} in {c_name}, {err}')
-            else:
-                flash(f'{people.cl_people_id} updated {now}')
+            flash(f'WARNING: {key} already exists in {c_name}, not saved')
+            return render_template('people_edit.html', title="New People", user = current_user, form=form)
+        elif read_alias(key) != '':
+            flash(f'WARNING: {key} was renamed to {read_alias(key)}, not saved')
+            return render_template('people_edit.html', title="New People", user = current_user, form=form)
         else:
             err = dataset.create(c_name, key, people.to_dict())
             if err != '':
                 flash(f'WARNING: failed to create {key} in {c_name}, {err}')
             else:
                 flash(f'{people.cl_people_id} created {now}')
+                flash_warnings(people)
         return redirect(url_for('people_edit', cl_people_id = people.cl_people_id))
+    # ?from=KEY prefills the form with the shared fields (see
+    # People.clone_fields) of an existing record, following aliases
+    # left by renames to it (see people_clone).
+    from_id = request.args.get('from', '')
+    if from_id != '' and request.method == 'GET':
+        src = People()
+        seen = []
+        src.load(from_id)
+        while src.alias != '' and src.alias not in seen:
+            seen.append(src.alias)
+            alias, src = src.alias, People()
+            src.load(alias)
+        for field in src.clone_fields:
+            getattr(form, field).data = getattr(src, field)
     return render_template('people_edit.html', title="New People", user = current_user, form=form)
 
 
-@app.route('/people/edit/<cl_people_id>', methods = [ "GET", "POST" ])
+# Clone a person, opens the new person form prefilled from an existing
+# record so shared metadata doesn't need retyping.
+@app.route('/people/clone/<path:cl_people_id>')
+def people_clone(cl_people_id):
+    return redirect(url_for('people_new', **{ 'from': cl_people_id }))
+
+
+# NOTE: cl_people_id uses the path converter so identifiers containing
+# slashes (e.g. doi:10.1234/abcd) or URL encoded characters (e.g.
+# spaces) are passed through to dataset as a single key.
+@app.route('/people/edit/<path:cl_people_id>', methods = [ "GET", "POST" ])
 def people_edit(cl_people_id):
     if current_user.is_authenticated == False:
         flash(f'Must be logged in to curate people')
         return redirect(url_for('index'))
     people = People()
     people.load(cl_people_id)
+    if people.alias != '':
+        return redirect(url_for('people_edit', cl_people_id = people.alias), code = 301)
+    # Saves always go to the key loaded from the URL, never to a key
+    # taken from the submitted form.
+    c_name = cfg.OBJECTS
+    key = normalize_key(c_name, cl_people_id)
+    exists = dataset.key_exists(c_name, key)
+    stored = people.to_dict()
+    stored_etag = people.etag()
     form = PeopleForm()
     if form.validate_on_submit():
         people.cl_people_id = form.cl_people_id.data
@@ -188,23 +472,40 @@ def people_edit(cl_people_id):
         people.faculty = form.faculty.data
         people.alumn = form.alumn.data
         people.notes = form.notes.data
-        c_name = cfg.OBJECTS
-        key = people.cl_people_id
         now = datetime.now()
-        if dataset.key_exists(c_name, key):
+        errors = people.check_update(stored)
+        if normalize_key(c_name, people.cl_people_id) != key:
+            errors.insert(0, f'cl_people_id must be {cl_people_id}, use andor-admin rename to change it')
+        # An etag that doesn't match means someone else saved the
+        # record after this form was rendered, a missing etag means
+        # we can't tell so it is treated the same way.
+        if form.etag.data != stored_etag:
+            errors.insert(0, 'it was changed by someone else, reload it and reapply your edits')
+        if len(errors) > 0:
+            for error in errors:
+                flash(f'WARNING: {key} not saved, {error}')
+        elif exists:
             err = dataset.update(c_name, key, people.to_dict())
             if err != '':
                 flash(f'WARNING: failed to update {key} in {c_name}, {err}')
             else:
                 flash(f'{people.cl_people_id} updated {now}')
+                flash_warnings(people)
+                form.etag.data = people.etag()
+        elif dataset.key_exists(c_name, key):
+            # Someone else created it after this form was rendered
+            flash(f'WARNING: {key} already exists in {c_name}, not saved')
         else:
             err = dataset.create(c_name, key, people.to_dict())
             if err != '':
                 flash(f'WARNING: failed to create {key} in {c_name}, {err}')
             else:
                 flash(f'{people.cl_people_id} created {now}')
+                flash_warnings(people)
+                form.etag.data = people.etag()
     else:
-        form.cl_people_id.data = people.cl_people_id 
+        form.etag.data = stored_etag
+        form.cl_people_id.data = people.cl_people_id or cl_people_id
         form.family_name.data = people.family_name 
         form.given_name.data = people.given_name 
         form.thesis_id.data = people.thesis_id 
@@ -240,7 +541,11 @@ def login():
         if u.check_password(password) == False:
             flash('Invalid username or password')
             return abort(401)
+        if u.is_active == False:
+            flash(f'{username} has been deactivated')
+            return abort(401)
         login_user(user = u, remember=remember_me, fresh = True)
+        u.record_login()
         #flash('Logged in successfully.')
         return redirect(url_for('people_list'))
     return render_template('login.html', title="Sign in", user = current_user, form=form)
@@ -14,6 +14,8 @@ flask_env = os.getenv('FLASK_ENV') or ''
 print(f"cfg.USERS -> {cfg.USERS}")
 print(f"cfg.ROLES -> {cfg.ROLES}")
 print(f"cfg.OBJECTS -> {cfg.OBJECTS}")
+aliases = getattr(cfg, 'ALIASES', '')
+print(f"cfg.ALIASES -> {aliases}")
 print(f"FLASK_ENV -> {flask_env}")
 if flask_env != 'development':
     print(f'''
@@ -24,7 +26,7 @@ You are not running a development deployment. You need to manaully
 remove the following files if you really want to reset and delete
 the content of this And/Or repository!
 
-    rm -fR {cfg.USERS} {cfg.ROLES} {cfg.OBJECTS} config.py
+    rm -fR {cfg.USERS} {cfg.ROLES} {cfg.OBJECTS} {aliases} config.py
 
 ''')
     sys.exit(1)
@@ -35,5 +37,7 @@ if os.path.exists(cfg.ROLES):
     shutil.rmtree(cfg.ROLES)
 if os.path.exists(cfg.OBJECTS):
     shutil.rmtree(cfg.OBJECTS)
+if aliases != '' and os.path.exists(aliases):
+    shutil.rmtree(aliases)
 if os.path.exists('config.py'):
     os.remove('config.py')
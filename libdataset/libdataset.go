@@ -503,19 +503,26 @@ func key_sort(cName, cKeyListExpr, cSortExpr *C.char) *C.char {
 	return C.CString(txt)
 }
 
-// count returns the number of objects (records) in a collection.
-// if an error is encounter a -1 is returned.
+// count returns the number of objects (records) in a collection,
+// opening the collection if needed. If an error is encounter a -1
+// is returned.
+//
 //export count
 func count(cName *C.char) C.int {
 	collectionName := C.GoString(cName)
 	error_clear()
-	if dataset.IsOpen(collectionName) {
-		if c, err := dataset.GetCollection(collectionName); err == nil {
-			i := c.Length()
-			return C.int(i)
+	if dataset.IsOpen(collectionName) == false {
+		if err := dataset.Open(collectionName); err != nil {
+			error_dispatch(err, "%s", err)
+			return C.int(-1)
 		}
 	}
-	return C.int(-1)
+	c, err := dataset.GetCollection(collectionName)
+	if err != nil {
+		error_dispatch(err, "Cannot open %q, %s", collectionName, err)
+		return C.int(-1)
+	}
+	return C.int(c.Length())
 }
 
 // import_csv - import a CSV file into a collection